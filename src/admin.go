@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type connCtxKey int
+
+// connKey carries the *connection trackedServeHTTP registered for this
+// request, so directorFunc can fill in Upstream once a backend is picked.
+const connKey connCtxKey = iota
+
+// connection is one entry in GET /apps/{name}/connections.
+type connection struct {
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Upstream  string    `json:"upstream,omitempty"`
+	StartTime time.Time `json:"start_time"`
+}
+
+type backendSummary struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+}
+
+type appSummary struct {
+	Name       string           `json:"name"`
+	ServerName string           `json:"server_name"`
+	Backends   []backendSummary `json:"backends"`
+	InFlight   int              `json:"in_flight"`
+	QueueDepth int              `json:"queue_depth"`
+}
+
+// snapshotConnections returns a point-in-time copy of app's in-flight
+// connections, safe to JSON-encode outside of app.connMu.
+func (app *App) snapshotConnections() []connection {
+	app.connMu.Lock()
+	defer app.connMu.Unlock()
+
+	out := make([]connection, 0, len(app.conns))
+	for _, c := range app.conns {
+		out = append(out, *c)
+	}
+	return out
+}
+
+// startAdminServer exposes the Clash-style control API described in the
+// admin_port/admin_token config fields. It stays off entirely unless
+// admin_port is set, and rejects every request unless admin_token matches -
+// there is no "running with auth disabled" mode.
+func startAdminServer(global Global) {
+	if global.AdminPort == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apps", adminAuth(global.AdminToken, handleListApps))
+	mux.HandleFunc("/apps/", adminAuth(global.AdminToken, handleAppRoute))
+	mux.HandleFunc("/reload", adminAuth(global.AdminToken, handleReload))
+
+	go func() {
+		log.Printf("Starting Admin API on %s", global.AdminPort)
+		log.Fatal(http.ListenAndServe(global.AdminPort, mux))
+	}()
+}
+
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Admin API: failed to encode response:", err)
+	}
+}
+
+// GET /apps
+func handleListApps(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Load().(*Config)
+
+	summaries := make([]appSummary, 0, len(cfg.Apps))
+	for name, app := range cfg.Apps {
+		backends := make([]backendSummary, len(app.backendStates))
+		for i, s := range app.backendStates {
+			backends[i] = backendSummary{URL: s.url.String(), Healthy: !s.isDown()}
+		}
+
+		// semaphore/queueSlots can be swapped out from under us by
+		// resizeSemaphore/resizeQueue (PATCH /apps/{name}), so reading their
+		// length needs the same RLock requestHandler takes.
+		app.resizeMu.RLock()
+		inFlight := len(app.semaphore)
+		queueDepth := len(app.queueSlots)
+		app.resizeMu.RUnlock()
+
+		summaries = append(summaries, appSummary{
+			Name:       name,
+			ServerName: app.ServerName,
+			Backends:   backends,
+			InFlight:   inFlight,
+			QueueDepth: queueDepth,
+		})
+	}
+	writeJSON(w, summaries)
+}
+
+// POST /reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	newCfg, err := loadConfig(configPath)
+	if err != nil {
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	configLock.Lock()
+	oldCfg := config.Load().(*Config)
+	config.Store(newCfg)
+	configLock.Unlock()
+	stopHealthChecks(oldCfg)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Dispatches /apps/{name}/connections, /apps/{name}/backends and
+// PATCH /apps/{name}.
+func handleAppRoute(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/apps/"), "/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg := config.Load().(*Config)
+	app, ok := cfg.Apps[parts[0]]
+	if !ok {
+		http.Error(w, "Unknown app", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "connections" && r.Method == http.MethodGet:
+		writeJSON(w, app.snapshotConnections())
+	case len(parts) == 2 && parts[1] == "backends" && r.Method == http.MethodPost:
+		handleBackendAction(w, r, app)
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		handlePatchApp(w, r, app)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// POST /apps/{name}/backends {"backend": "...", "action": "drain"|"enable"}
+func handleBackendAction(w http.ResponseWriter, r *http.Request, app *App) {
+	var body struct {
+		Backend string `json:"backend"`
+		Action  string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	state := stateByURLString(app.backendStates, body.Backend)
+	if state == nil {
+		http.Error(w, "Unknown backend", http.StatusNotFound)
+		return
+	}
+
+	switch body.Action {
+	case "drain":
+		atomic.StoreInt32(&state.manualDown, 1)
+	case "enable":
+		atomic.StoreInt32(&state.manualDown, 0)
+		state.recordSuccess()
+	default:
+		http.Error(w, "Unknown action (must be drain or enable)", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func stateByURLString(states []*backendState, raw string) *backendState {
+	for _, s := range states {
+		if s.url.String() == raw {
+			return s
+		}
+	}
+	return nil
+}
+
+// PATCH /apps/{name} {"max_requests": 100, "queue_size": 50}
+func handlePatchApp(w http.ResponseWriter, r *http.Request, app *App) {
+	var body struct {
+		MaxRequests *int `json:"max_requests"`
+		QueueSize   *int `json:"queue_size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.MaxRequests != nil {
+		app.MaxRequests = *body.MaxRequests
+		app.resizeSemaphore(*body.MaxRequests)
+	}
+	if body.QueueSize != nil {
+		app.QueueSize = *body.QueueSize
+		app.resizeQueue(*body.QueueSize)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendState tracks passive health and in-flight count for one backend,
+// shared by every Balancer implementation so a backend that trips the
+// consecutive-error threshold drops out of rotation no matter which
+// strategy is picking.
+type backendState struct {
+	url       *url.URL
+	weight    int
+	current   int // smooth weighted round-robin accumulator; guarded by weightedBalancer.mu
+	inFlight  int64
+	failures  int32
+	downUntil int64 // unix nano; 0 means healthy
+
+	// Set by the active health checker in health.go. Starts at 1 (healthy)
+	// so a backend isn't presumed dead before its first probe completes.
+	activeHealthy   int32
+	consecutiveOK   int32
+	consecutiveFail int32
+
+	// manualDown is set via the admin API's POST /apps/{name}/backends to
+	// drain a backend until explicitly re-enabled.
+	manualDown int32
+}
+
+func (b *backendState) recordFailure(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	if int(atomic.AddInt32(&b.failures, 1)) >= threshold {
+		atomic.StoreInt64(&b.downUntil, time.Now().Add(cooldown).UnixNano())
+	}
+}
+
+func (b *backendState) recordSuccess() {
+	atomic.StoreInt32(&b.failures, 0)
+	atomic.StoreInt64(&b.downUntil, 0)
+}
+
+func (b *backendState) isDown() bool {
+	if atomic.LoadInt32(&b.manualDown) == 1 {
+		return true
+	}
+	if atomic.LoadInt32(&b.activeHealthy) == 0 {
+		return true
+	}
+	until := atomic.LoadInt64(&b.downUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+type balancerCtxKey int
+
+// pickedBackendKey carries the *url.URL a Balancer picked for a request on
+// its context, so ModifyResponse/ErrorHandler can release it and feed
+// passive failure tracking without re-deriving it from the (by then
+// Director-rewritten) request URL.
+const pickedBackendKey balancerCtxKey = iota
+
+// Balancer picks a backend for a request and is notified when that request
+// finishes, so connection-aware strategies (least_conn) can keep an accurate
+// outstanding-request count.
+type Balancer interface {
+	Pick(r *http.Request) *url.URL
+	Release(u *url.URL)
+}
+
+// healthy returns the subset of states not currently down (tripped by
+// passive failure tracking, failing active health checks, or drained via the
+// admin API), falling back to the full set if every backend is down
+// so callers always get a target rather than nil.
+func healthy(states []*backendState) []*backendState {
+	out := make([]*backendState, 0, len(states))
+	for _, s := range states {
+		if !s.isDown() {
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return states
+	}
+	return out
+}
+
+func stateByURL(states []*backendState, u *url.URL) *backendState {
+	for _, s := range states {
+		if s.url == u {
+			return s
+		}
+	}
+	return nil
+}
+
+// roundRobinBalancer is the proxy's long-standing default strategy.
+type roundRobinBalancer struct {
+	states  []*backendState
+	current uint32
+}
+
+func (b *roundRobinBalancer) Pick(r *http.Request) *url.URL {
+	candidates := healthy(b.states)
+	index := atomic.AddUint32(&b.current, 1)
+	return candidates[index%uint32(len(candidates))].url
+}
+
+func (b *roundRobinBalancer) Release(u *url.URL) {}
+
+type randomBalancer struct {
+	states []*backendState
+}
+
+func (b *randomBalancer) Pick(r *http.Request) *url.URL {
+	candidates := healthy(b.states)
+	return candidates[rand.Intn(len(candidates))].url
+}
+
+func (b *randomBalancer) Release(u *url.URL) {}
+
+// leastConnBalancer sends each request to whichever healthy backend has the
+// fewest outstanding requests, as tracked via Pick/Release.
+type leastConnBalancer struct {
+	states []*backendState
+}
+
+func (b *leastConnBalancer) Pick(r *http.Request) *url.URL {
+	candidates := healthy(b.states)
+	best := candidates[0]
+	for _, s := range candidates[1:] {
+		if atomic.LoadInt64(&s.inFlight) < atomic.LoadInt64(&best.inFlight) {
+			best = s
+		}
+	}
+	atomic.AddInt64(&best.inFlight, 1)
+	return best.url
+}
+
+func (b *leastConnBalancer) Release(u *url.URL) {
+	if s := stateByURL(b.states, u); s != nil {
+		atomic.AddInt64(&s.inFlight, -1)
+	}
+}
+
+// ipHashBalancer uses rendezvous (highest random weight) hashing so the
+// client-to-backend mapping stays stable as backends are added or removed,
+// unlike a plain modulo hash.
+type ipHashBalancer struct {
+	states []*backendState
+}
+
+func clientKey(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (b *ipHashBalancer) Pick(r *http.Request) *url.URL {
+	key := clientKey(r)
+	candidates := healthy(b.states)
+
+	var best *backendState
+	var bestScore uint64
+	for _, s := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(s.url.String()))
+		score := h.Sum64()
+		if best == nil || score > bestScore {
+			best = s
+			bestScore = score
+		}
+	}
+	return best.url
+}
+
+func (b *ipHashBalancer) Release(u *url.URL) {}
+
+// weightedBalancer implements smooth weighted round-robin (the same
+// algorithm nginx uses), so a backend parsed as "url#weight=5" receives
+// roughly 5x the traffic of a weight-1 backend while still smoothing bursts.
+type weightedBalancer struct {
+	mu     sync.Mutex
+	states []*backendState
+}
+
+func (b *weightedBalancer) Pick(r *http.Request) *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := healthy(b.states)
+	var best *backendState
+	total := 0
+	for _, s := range candidates {
+		s.current += s.weight
+		total += s.weight
+		if best == nil || s.current > best.current {
+			best = s
+		}
+	}
+	best.current -= total
+	return best.url
+}
+
+func (b *weightedBalancer) Release(u *url.URL) {}
+
+// parseBackend splits a "url#weight=N" backend entry into the bare URL and
+// its weight (defaulting to 1 when no fragment, or an invalid one, is given).
+func parseBackend(raw string) (*url.URL, int, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	weight := 1
+	if u.Fragment != "" {
+		if parsed, ferr := strconv.Atoi(strings.TrimPrefix(u.Fragment, "weight=")); ferr == nil && parsed > 0 {
+			weight = parsed
+		}
+		u.Fragment = ""
+	}
+	return u, weight, nil
+}
+
+// newBalancer builds the Balancer named by loadBalance, defaulting to
+// round_robin (the proxy's historical behavior) for an unrecognized or
+// empty value.
+func newBalancer(loadBalance string, states []*backendState) Balancer {
+	switch loadBalance {
+	case "random":
+		return &randomBalancer{states: states}
+	case "least_conn":
+		return &leastConnBalancer{states: states}
+	case "ip_hash":
+		return &ipHashBalancer{states: states}
+	case "weighted":
+		return &weightedBalancer{states: states}
+	default:
+		return &roundRobinBalancer{states: states}
+	}
+}
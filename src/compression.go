@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// CompressionPolicy is an App's `[apps.foo.compression]` block.
+type CompressionPolicy struct {
+	Enabled bool     `toml:"enabled"`
+	MinSize int      `toml:"min_size"` // skip compressing responses smaller than this, in bytes
+	Types   []string `toml:"types"`    // MIME globs, e.g. "text/*", "application/json"; defaults cover the common text types
+	Level   int      `toml:"level"`    // 1 (fastest) to 9 (smallest); 0 uses gzip's default
+
+	typeGlobs []glob.Glob
+}
+
+var defaultCompressionTypes = []string{"text/*", "application/json", "application/javascript", "application/xml"}
+
+func (p *CompressionPolicy) compile() error {
+	types := p.Types
+	if len(types) == 0 {
+		types = defaultCompressionTypes
+	}
+	p.typeGlobs = make([]glob.Glob, len(types))
+	for i, t := range types {
+		g, err := glob.Compile(t)
+		if err != nil {
+			return fmt.Errorf("invalid compression.types pattern: %w", err)
+		}
+		p.typeGlobs[i] = g
+	}
+
+	// gzip.NewWriterLevel only accepts gzip.HuffmanOnly (-2) through
+	// gzip.BestCompression (9); catch a typo'd level here instead of at
+	// request time, where a construction error would leave Content-Encoding
+	// set to gzip on an uncompressed body.
+	if p.Level != 0 && (p.Level < gzip.HuffmanOnly || p.Level > gzip.BestCompression) {
+		return fmt.Errorf("invalid compression.level %d: must be between %d and %d", p.Level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+func (p *CompressionPolicy) level() int {
+	if p.Level == 0 {
+		return gzip.DefaultCompression
+	}
+	return p.Level
+}
+
+func (p *CompressionPolicy) matchesType(contentType string) bool {
+	mediaType := contentType
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		mediaType = contentType[:i]
+	}
+	mediaType = strings.TrimSpace(mediaType)
+
+	for _, g := range p.typeGlobs {
+		if g.Match(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxCompressionPeek bounds how many bytes compressingResponseWriter will
+// buffer while waiting to learn the size of a response with no
+// Content-Length (chunked/streamed bodies), so compression.min_size can
+// still apply to them. A response that's still being written once this many
+// bytes have passed through is treated as large enough to compress (if
+// otherwise eligible) and stops being buffered, so a long-lived stream
+// doesn't sit in memory indefinitely.
+const maxCompressionPeek = 32 * 1024
+
+// compressingResponseWriter wraps the ResponseWriter passed into
+// proxy.ServeHTTP. Type/encoding eligibility is decided in WriteHeader,
+// by which point httputil.ReverseProxy has already copied the upstream
+// response's headers onto it. If Content-Length is present the min_size
+// check is decided there too; otherwise Write buffers up to
+// maxCompressionPeek bytes (or until the response ends) so min_size still
+// applies to a chunked response instead of silently compressing regardless
+// of size. It implements Flusher and Hijacker so it doesn't break the
+// SSE/WebSocket long-running-request path - Flush forces the buffering
+// decision early, since a flush before the peek cap means the caller wants
+// these bytes on the wire now.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	req    *http.Request
+	policy *CompressionPolicy
+
+	status        int
+	headerWritten bool
+	decided       bool
+	buf           bytes.Buffer
+	gz            *gzip.Writer
+}
+
+func newCompressingResponseWriter(w http.ResponseWriter, r *http.Request, policy *CompressionPolicy) *compressingResponseWriter {
+	return &compressingResponseWriter{ResponseWriter: w, req: r, policy: policy}
+}
+
+func (c *compressingResponseWriter) WriteHeader(status int) {
+	c.status = status
+	c.headerWritten = true
+
+	if !c.eligibleByTypeAndEncoding() {
+		c.finalize(false)
+		return
+	}
+
+	if cl := c.Header().Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		c.finalize(err == nil && n >= c.policy.MinSize)
+		return
+	}
+
+	if c.policy.MinSize <= 0 {
+		c.finalize(true)
+		return
+	}
+
+	// No Content-Length: leave c.decided false. Write/Flush/Close resolve
+	// min_size once they've seen enough of the body (or all of it).
+}
+
+// eligibleByTypeAndEncoding checks everything about compression eligibility
+// that doesn't depend on the response's size.
+func (c *compressingResponseWriter) eligibleByTypeAndEncoding() bool {
+	if !c.policy.Enabled || !acceptsGzip(c.req) {
+		return false
+	}
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false // already encoded upstream
+	}
+	return c.policy.matchesType(h.Get("Content-Type"))
+}
+
+// finalize commits to compressing or not, writes the real status line, and
+// (if compressing) sets up the gzip writer. It must be called exactly once.
+func (c *compressingResponseWriter) finalize(compress bool) {
+	c.decided = true
+	if compress {
+		h := c.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		// Level is validated by CompressionPolicy.compile() at config load, so
+		// this can't fail; NewWriter never does.
+		c.gz, _ = gzip.NewWriterLevel(c.ResponseWriter, c.policy.level())
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+// releaseBuffered writes out whatever Write buffered while the min_size
+// decision was pending, through the gzip writer if finalize chose to
+// compress.
+func (c *compressingResponseWriter) releaseBuffered() error {
+	buffered := c.buf.Bytes()
+	c.buf = bytes.Buffer{}
+	if len(buffered) == 0 {
+		return nil
+	}
+	if c.gz != nil {
+		_, err := c.gz.Write(buffered)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buffered)
+	return err
+}
+
+func (c *compressingResponseWriter) Write(p []byte) (int, error) {
+	if c.decided {
+		if c.gz != nil {
+			return c.gz.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+
+	c.buf.Write(p)
+	threshold := c.policy.MinSize
+	if threshold > maxCompressionPeek {
+		threshold = maxCompressionPeek
+	}
+	if c.buf.Len() < threshold {
+		return len(p), nil
+	}
+
+	// Reaching min_size, or the peek cap when min_size is larger, both count
+	// as large enough to compress.
+	c.finalize(true)
+	if err := c.releaseBuffered(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *compressingResponseWriter) Flush() {
+	if c.headerWritten && !c.decided {
+		// The caller wants these bytes on the wire now, so the response's
+		// final size is whatever we've buffered so far.
+		c.finalize(c.buf.Len() >= c.policy.MinSize)
+		c.releaseBuffered()
+	}
+	if c.gz != nil {
+		c.gz.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Close resolves a still-pending min_size decision against the response's
+// now-known final size, then flushes and closes the gzip stream if one was
+// opened. Callers must invoke this after the proxied response has been
+// fully written.
+func (c *compressingResponseWriter) Close() error {
+	if c.headerWritten && !c.decided {
+		c.finalize(c.buf.Len() >= c.policy.MinSize)
+		if err := c.releaseBuffered(); err != nil {
+			return err
+		}
+	}
+	if c.gz != nil {
+		return c.gz.Close()
+	}
+	return nil
+}
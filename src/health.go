@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthThreshold     = 1
+)
+
+// startHealthChecks spawns one goroutine that periodically probes every
+// backend in app.backendStates, as long as health_check_path is configured.
+// The goroutine runs until stopHealthChecks cancels app.healthCancel.
+func (app *App) startHealthChecks() {
+	if app.HealthCheckPath == "" || len(app.backendStates) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.healthCancel = cancel
+	go app.runHealthChecks(ctx)
+}
+
+// stopHealthChecks cancels every app's health-check goroutine in cfg. It is
+// called on the previous config after a reload swaps it out, so a watched
+// config.toml edit doesn't leave orphaned checkers probing stale backends.
+func stopHealthChecks(cfg *Config) {
+	if cfg == nil {
+		return
+	}
+	for _, app := range cfg.Apps {
+		if app.healthCancel != nil {
+			app.healthCancel()
+		}
+	}
+}
+
+func (app *App) runHealthChecks(ctx context.Context) {
+	interval := time.Duration(app.HealthCheckIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	timeout := time.Duration(app.HealthCheckTimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, s := range app.backendStates {
+			app.probeBackend(client, s)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) probeBackend(client *http.Client, s *backendState) {
+	target := *s.url
+	target.Path = target.Path + app.HealthCheckPath
+
+	resp, err := client.Get(target.String())
+	ok := err == nil && resp.StatusCode < 500
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	unhealthyThreshold := app.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultHealthThreshold
+	}
+	healthyThreshold := app.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthThreshold
+	}
+
+	if ok {
+		atomic.StoreInt32(&s.consecutiveFail, 0)
+		if int(atomic.AddInt32(&s.consecutiveOK, 1)) >= healthyThreshold {
+			atomic.StoreInt32(&s.activeHealthy, 1)
+		}
+	} else {
+		atomic.StoreInt32(&s.consecutiveOK, 0)
+		if int(atomic.AddInt32(&s.consecutiveFail, 1)) >= unhealthyThreshold {
+			atomic.StoreInt32(&s.activeHealthy, 0)
+		}
+	}
+
+	backendHealthy.WithLabelValues(app.ServerName, s.url.Host).Set(float64(atomic.LoadInt32(&s.activeHealthy)))
+}
+
+// allBackendsUnhealthy reports whether every backend is currently passively
+// or actively marked down or drained via the admin API, in which case requestHandler short-circuits
+// instead of dispatching to a proxy that has nowhere healthy to send to.
+func (app *App) allBackendsUnhealthy() bool {
+	if len(app.backendStates) == 0 {
+		return false
+	}
+	for _, s := range app.backendStates {
+		if !s.isDown() {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -10,8 +11,11 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/fsnotify/fsnotify"
@@ -19,26 +23,49 @@ import (
 )
 
 type App struct {
-	ServerName   string   `toml:"server_name"`
-	Backends     []string `toml:"backends"`
-	MaxRequests  int      `toml:"max_requests"`
-	QueueSize    int      `toml:"queue_size"`
-	LoadBalance  string   `toml:"load_balance"`
-	Debug        bool     `toml:"debug"`
-	currentIndex uint32
-	backendUrls  []*url.URL
-	compiledGlob glob.Glob
-	semaphore    chan struct{}
-	queueSlots   chan struct{}
-	proxy        *httputil.ReverseProxy
+	ServerName             string            `toml:"server_name"`
+	Backends               []string          `toml:"backends"`
+	MaxRequests            int               `toml:"max_requests"`
+	QueueSize              int               `toml:"queue_size"`
+	LoadBalance            string            `toml:"load_balance"`
+	Debug                  bool              `toml:"debug"`
+	LongRunningPaths       []string          `toml:"long_running_paths"`
+	LongRunningMethods     []string          `toml:"long_running_methods"`
+	MaxLongRunning         int               `toml:"max_long_running"`
+	PassiveFailThreshold   int               `toml:"passive_fail_threshold"`    // consecutive 5xx/connect errors before a backend is pulled from rotation
+	PassiveFailCooldownSec int               `toml:"passive_fail_cooldown_sec"` // how long a tripped backend stays out before being retried
+	HealthCheckPath        string            `toml:"health_check_path"`         // empty disables active health checks
+	HealthCheckIntervalSec int               `toml:"health_check_interval_sec"`
+	HealthCheckTimeoutSec  int               `toml:"health_check_timeout_sec"`
+	UnhealthyThreshold     int               `toml:"unhealthy_threshold"` // consecutive failed probes before a backend is marked down
+	HealthyThreshold       int               `toml:"healthy_threshold"`   // consecutive successful probes before a backend is marked up again
+	CORS                   *CORSPolicy       `toml:"cors"`
+	Compression            CompressionPolicy `toml:"compression"`
+	backendUrls            []*url.URL
+	backendStates          []*backendState
+	balancer               Balancer
+	compiledGlob           glob.Glob
+	longRunningGlobs       []glob.Glob
+	semaphore              chan struct{}
+	queueSlots             chan struct{}
+	longSemaphore          chan struct{}
+	proxy                  *httputil.ReverseProxy
+	healthCancel           context.CancelFunc
+	resizeMu               sync.RWMutex // guards semaphore/queueSlots: writers (resize) take Lock, readers take RLock
+	connMu                 sync.Mutex   // guards conns and each connection's Upstream field
+	connSeq                uint64
+	conns                  map[string]*connection
 }
 
 type Global struct {
 	ListenPort  string `toml:"listen_port"`
 	TLSCertPath string `toml:"tls_cert_path"`
 	TLSKeyPath  string `toml:"tls_key_path"`
-	CdnPort     string `toml:"cdn_port"` // Local Static Web Server Listen Port
-	CdnRoot     string `toml:"cdn_root"` // Local Static Web Server Root Directory
+	CdnPort     string `toml:"cdn_port"`     // Local Static Web Server Listen Port
+	CdnRoot     string `toml:"cdn_root"`     // Local Static Web Server Root Directory
+	MetricsPort string `toml:"metrics_port"` // Dedicated /metrics listen port; falls back to CdnPort if empty
+	AdminPort   string `toml:"admin_port"`   // Admin API listen port; admin API disabled if empty
+	AdminToken  string `toml:"admin_token"`  // Bearer token required by every admin API request
 }
 
 type Config struct {
@@ -49,13 +76,20 @@ type Config struct {
 var (
 	config     atomic.Value
 	configLock sync.RWMutex
+
+	// defaultCORS answers preflight/error responses written before any app
+	// has been matched (e.g. "no matching application").
+	defaultCORS = defaultCORSPolicy()
+
+	// configPath is set once in main and read by the admin API's POST /reload.
+	configPath string
 )
 
 const VERSION = "v2.0.1"
 
 func main() {
 	v := flag.Bool("v", false, "show version and exit")
-	configPath := flag.String("f", "config.toml", "Path to config.toml")
+	configPathFlag := flag.String("f", "config.toml", "Path to config.toml")
 	flag.Parse()
 
 	if *v {
@@ -63,7 +97,9 @@ func main() {
 		return
 	}
 
-	cfg, err := loadConfig(*configPath)
+	configPath = *configPathFlag
+
+	cfg, err := loadConfig(configPath)
 	if err != nil {
 		log.Fatal("Config load error:", err)
 	}
@@ -77,13 +113,16 @@ func main() {
 		log.Fatalf("Failed to create local static web root directory: %s", global.CdnRoot)
 	}
 
-	go watchConfig(*configPath)
+	go watchConfig(configPath)
+	startAdminServer(global)
 
 	// Run Local Static Web Server
+	cdnMux := http.NewServeMux()
+	cdnMux.Handle("/", http.FileServer(http.Dir(global.CdnRoot)))
+	startMetricsServer(global, cdnMux)
 	go func() {
-		http.Handle("/", http.FileServer(http.Dir(global.CdnRoot)))
 		log.Printf("Starting Local Static Web Server on %s with root-dir: %s", global.CdnPort, global.CdnRoot)
-		log.Fatal(http.ListenAndServe(global.CdnPort, nil))
+		log.Fatal(http.ListenAndServe(global.CdnPort, cdnMux))
 	}()
 
 	handler := http.HandlerFunc(requestHandler)
@@ -118,12 +157,37 @@ func loadConfig(path string) (*Config, error) {
 		app.compiledGlob = g
 
 		app.backendUrls = make([]*url.URL, len(app.Backends))
+		app.backendStates = make([]*backendState, len(app.Backends))
 		for i, b := range app.Backends {
-			u, err := url.Parse(b)
+			u, weight, err := parseBackend(b)
 			if err != nil {
 				return nil, fmt.Errorf("invalid backend URL: %w", err)
 			}
 			app.backendUrls[i] = u
+			app.backendStates[i] = &backendState{url: u, weight: weight, activeHealthy: 1}
+		}
+		app.balancer = newBalancer(app.LoadBalance, app.backendStates)
+		app.startHealthChecks()
+
+		if app.CORS == nil {
+			app.CORS = defaultCORSPolicy()
+		} else if err := app.CORS.compile(); err != nil {
+			return nil, err
+		}
+
+		if err := app.Compression.compile(); err != nil {
+			return nil, err
+		}
+
+		app.conns = make(map[string]*connection)
+
+		app.longRunningGlobs = make([]glob.Glob, len(app.LongRunningPaths))
+		for i, p := range app.LongRunningPaths {
+			g, err := glob.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid long_running_paths pattern: %w", err)
+			}
+			app.longRunningGlobs[i] = g
 		}
 
 		// セマフォで同時実行数を制限
@@ -132,22 +196,30 @@ func loadConfig(path string) (*Config, error) {
 		// キューサイズで待機数を制限
 		app.queueSlots = make(chan struct{}, app.QueueSize)
 
+		// SSE/WebSocket等の長時間接続は別プールで管理し、通常リクエストを待たせない
+		app.longSemaphore = make(chan struct{}, app.MaxLongRunning)
+
 		app.proxy = &httputil.ReverseProxy{
 			Director:     directorFunc(app),
 			ErrorHandler: errorHandlerFunc(app),
 			ModifyResponse: func(resp *http.Response) error {
-				h := resp.Header
-				// 既存のCORS関連ヘッダーを全て削除
-				h.Del("Access-Control-Allow-Origin")
-				h.Del("Access-Control-Allow-Methods")
-				h.Del("Access-Control-Allow-Headers")
-				h.Del("Access-Control-Allow-Credentials")
-				h.Del("Access-Control-Expose-Headers")
-				h.Del("Access-Control-Max-Age")
-				h.Del("X-Frame-Options")
-				h.Del("Content-Security-Policy")
-				// 必要なヘッダーを再セット
-				setCORSHeaders(h)
+				if !app.CORS.Passthrough {
+					h := resp.Header
+					// 既存のCORS関連ヘッダーを全て削除（X-Frame-Options/CSPなど
+					// CORS以外のヘッダーは対象外。上流の値をそのまま通す）
+					h.Del("Access-Control-Allow-Origin")
+					h.Del("Access-Control-Allow-Methods")
+					h.Del("Access-Control-Allow-Headers")
+					h.Del("Access-Control-Allow-Credentials")
+					h.Del("Access-Control-Expose-Headers")
+					h.Del("Access-Control-Max-Age")
+					// 必要なヘッダーを再セット
+					app.CORS.setHeaders(h, resp.Request.Header.Get("Origin"))
+				}
+				recordUpstreamMetrics(app, resp)
+				if target, ok := resp.Request.Context().Value(pickedBackendKey).(*url.URL); ok {
+					app.releaseBackend(target, resp.StatusCode < 500)
+				}
 				return nil
 			},
 		}
@@ -156,47 +228,117 @@ func loadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
-func setCORSHeaders(h http.Header) {
-	h.Set("Access-Control-Allow-Origin", "*")
-	h.Set("Access-Control-Allow-Methods", "*")
-	h.Set("Access-Control-Allow-Headers", "*")
-	h.Set("Access-Control-Allow-Credentials", "true")
-	h.Set("Access-Control-Expose-Headers", "*")
-	h.Set("Access-Control-Max-Age", "86400")
-	h.Set("X-Frame-Options", "ALLOWALL")
-	h.Set("Content-Security-Policy", "frame-ancestors *")
-}
-
 func directorFunc(app *App) func(*http.Request) {
 	return func(req *http.Request) {
-		target := app.getNextBackend()
+		target := app.balancer.Pick(req)
+		*req = *req.WithContext(context.WithValue(req.Context(), pickedBackendKey, target))
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path = target.Path + req.URL.Path
 		req.Host = target.Host
 		req.Header.Set("X-Forwarded-Host", req.Host)
+
+		if c, ok := req.Context().Value(connKey).(*connection); ok {
+			app.connMu.Lock()
+			c.Upstream = target.String()
+			app.connMu.Unlock()
+		}
+	}
+}
+
+// resizeSemaphore lets the admin API's PATCH /apps/{name} change MaxRequests
+// live by swapping in a freshly sized channel; in-flight requests keep using
+// the channel they acquired (see requestHandler's local `sem` capture).
+func (app *App) resizeSemaphore(n int) {
+	if n <= 0 {
+		return
 	}
+	app.resizeMu.Lock()
+	app.semaphore = make(chan struct{}, n)
+	app.resizeMu.Unlock()
+}
+
+// resizeQueue is resizeSemaphore's counterpart for QueueSize/queueSlots.
+func (app *App) resizeQueue(n int) {
+	if n <= 0 {
+		return
+	}
+	app.resizeMu.Lock()
+	app.queueSlots = make(chan struct{}, n)
+	app.resizeMu.Unlock()
+}
+
+// trackedServeHTTP wraps proxy.ServeHTTP with bookkeeping for the admin
+// API's GET /apps/{name}/connections: it registers a connection entry keyed
+// by a per-app sequence number, lets directorFunc fill in the Upstream once
+// a backend is picked, and deregisters on return.
+func (app *App) trackedServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strconv.FormatUint(atomic.AddUint64(&app.connSeq, 1), 10)
+	c := &connection{Method: r.Method, Path: r.URL.Path, StartTime: time.Now()}
+
+	app.connMu.Lock()
+	app.conns[id] = c
+	app.connMu.Unlock()
+
+	defer func() {
+		app.connMu.Lock()
+		delete(app.conns, id)
+		app.connMu.Unlock()
+	}()
+
+	cw := newCompressingResponseWriter(w, r, &app.Compression)
+	defer cw.Close()
+
+	app.proxy.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), connKey, c)))
 }
 
 func errorHandlerFunc(app *App) func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, r *http.Request, err error) {
-		setCORSHeaders(w.Header())
+		recordUpstreamError(app, r, http.StatusBadGateway)
+		if target, ok := r.Context().Value(pickedBackendKey).(*url.URL); ok {
+			app.releaseBackend(target, false)
+		}
+		app.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 	}
 }
 
-func (app *App) getNextBackend() *url.URL {
-	index := atomic.AddUint32(&app.currentIndex, 1)
-	return app.backendUrls[index%uint32(len(app.backendUrls))]
-}
+// releaseBackend tells the balancer a picked backend's request has finished
+// (for connection-aware strategies like least_conn) and feeds the outcome
+// into passive failure tracking so a backend with too many consecutive
+// 5xx/connect errors drops out of rotation.
+func (app *App) releaseBackend(target *url.URL, success bool) {
+	app.balancer.Release(target)
 
-func requestHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		setCORSHeaders(w.Header())
-		w.WriteHeader(http.StatusNoContent)
+	state := stateByURL(app.backendStates, target)
+	if state == nil {
 		return
 	}
+	if success {
+		state.recordSuccess()
+	} else {
+		cooldown := time.Duration(app.PassiveFailCooldownSec) * time.Second
+		state.recordFailure(app.PassiveFailThreshold, cooldown)
+	}
+}
+
+// isLongRunning reports whether r should bypass the normal MaxRequests/QueueSize
+// pool in favor of the dedicated long-running pool (SSE, WebSocket, large downloads).
+func (app *App) isLongRunning(r *http.Request) bool {
+	for _, m := range app.LongRunningMethods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	for _, g := range app.longRunningGlobs {
+		if g.Match(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
 
+func requestHandler(w http.ResponseWriter, r *http.Request) {
 	configLock.RLock()
 	cfg := config.Load().(*Config)
 	configLock.RUnlock()
@@ -210,48 +352,100 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if matchedApp == nil {
-		setCORSHeaders(w.Header())
+		defaultCORS.setHeaders(w.Header(), r.Header.Get("Origin"))
 		http.Error(w, "No matching application", http.StatusNotFound)
 		return
 	}
 
+	// プリフライトはマッチしたアプリのCORSポリシーで応答する。ただし
+	// passthrough = true の場合はバックエンド自身がCORSを扱う想定なので、
+	// ここで短絡させずバックエンドまでプロキシする。
+	if r.Method == http.MethodOptions && !matchedApp.CORS.Passthrough {
+		matchedApp.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if matchedApp.allBackendsUnhealthy() {
+		matchedApp.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
+		http.Error(w, "Service unavailable (no healthy backends)", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 長時間接続は専用プールへ。ここではボディの読み込み/再構築を挟まない。
+	// レスポンスライターは Hijacker/Flusher を実装した圧縮ラッパー経由で
+	// ServeHTTP に渡るので、WebSocket アップグレードや SSE のストリーミングを壊さない。
+	if matchedApp.isLongRunning(r) {
+		select {
+		case matchedApp.longSemaphore <- struct{}{}:
+			defer func() { <-matchedApp.longSemaphore }()
+		default:
+			longRunningRejectedTotal.WithLabelValues(matchedApp.ServerName).Inc()
+			matchedApp.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
+			http.Error(w, "Service unavailable (long-running pool full)", http.StatusServiceUnavailable)
+			return
+		}
+
+		matchedApp.trackedServeHTTP(w, withStartTime(r))
+		return
+	}
+
 	// リクエストボディを読み込む
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		setCORSHeaders(w.Header())
+		matchedApp.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 	r.Body.Close()
 
+	// max_requests/queue_size をライブ変更する PATCH /apps/{name} は
+	// チャンネルそのものを差し替えるので、以降はこのリクエストが使うチャンネルを
+	// ローカル変数に固定し、acquire/release の対を必ず同じチャンネルで揃える。
+	// resizeSemaphore/resizeQueue の書き込みと競合しないよう、読み取り側も
+	// resizeMu を取る。
+	matchedApp.resizeMu.RLock()
+	queue := matchedApp.queueSlots
+	sem := matchedApp.semaphore
+	matchedApp.resizeMu.RUnlock()
+
 	// まずキューに入れる（QueueSizeで制限）
 	select {
-	case matchedApp.queueSlots <- struct{}{}:
+	case queue <- struct{}{}:
+		queueDepth.WithLabelValues(matchedApp.ServerName).Set(float64(len(queue)))
 		defer func() {
-			<-matchedApp.queueSlots
+			<-queue
+			queueDepth.WithLabelValues(matchedApp.ServerName).Set(float64(len(queue)))
 			if matchedApp.Debug {
-				fmt.Printf("Running-Request: %d, Queue: %d\n", len(matchedApp.semaphore), len(matchedApp.queueSlots))
+				fmt.Printf("Running-Request: %d, Queue: %d\n", len(sem), len(queue))
 			}
 		}()
 	default:
-		setCORSHeaders(w.Header())
+		queueRejectedTotal.WithLabelValues(matchedApp.ServerName).Inc()
+		matchedApp.CORS.setHeaders(w.Header(), r.Header.Get("Origin"))
 		http.Error(w, "Service unavailable (queue full)", http.StatusServiceUnavailable)
 		return
 	}
 
 	// セマフォを取得（MaxRequestsで制限）- ここでブロッキング
-	matchedApp.semaphore <- struct{}{}
-	defer func() { <-matchedApp.semaphore }()
+	sem <- struct{}{}
+	inFlightRequests.WithLabelValues(matchedApp.ServerName).Set(float64(len(sem)))
+	defer func() {
+		<-sem
+		inFlightRequests.WithLabelValues(matchedApp.ServerName).Set(float64(len(sem)))
+	}()
 
 	if matchedApp.Debug {
-		fmt.Printf("Running-Request: %d, Queue: %d\n", len(matchedApp.semaphore), len(matchedApp.queueSlots))
+		fmt.Printf("Running-Request: %d, Queue: %d\n", len(sem), len(queue))
 	}
 
+	bytesInTotal.WithLabelValues(matchedApp.ServerName).Add(float64(len(body)))
+
 	// リクエストボディを復元
 	r.Body = io.NopCloser(bytes.NewReader(body))
 
 	// プロキシ実行
-	matchedApp.proxy.ServeHTTP(w, r)
+	matchedApp.trackedServeHTTP(w, withStartTime(r))
 }
 
 func watchConfig(path string) {
@@ -279,8 +473,10 @@ func watchConfig(path string) {
 					continue
 				}
 				configLock.Lock()
+				oldCfg := config.Load().(*Config)
 				config.Store(newCfg)
 				configLock.Unlock()
+				stopHealthChecks(oldCfg)
 			}
 		case err := <-watcher.Errors:
 			log.Println("Watcher error:", err)
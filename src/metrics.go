@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type ctxKey int
+
+const startTimeKey ctxKey = iota
+
+// withStartTime stashes the current time on r's context so recordUpstreamMetrics
+// can compute upstream latency once the response comes back through ModifyResponse.
+func withStartTime(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), startTimeKey, time.Now()))
+}
+
+// Metrics are registered once as package-level collectors labeled by
+// app/backend/method/status, so a config reload never needs to register or
+// unregister anything per-app and can never hit a "duplicate metrics
+// collector registration attempted" panic.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpxy_requests_total",
+		Help: "Total number of proxied requests, labeled by app, backend, method and status.",
+	}, []string{"app", "backend", "method", "status"})
+
+	inFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpxy_in_flight_requests",
+		Help: "Current number of requests occupying an app's semaphore (mirrors len(semaphore)).",
+	}, []string{"app"})
+
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpxy_queue_depth",
+		Help: "Current number of requests waiting in an app's queue (mirrors len(queueSlots)).",
+	}, []string{"app"})
+
+	queueRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpxy_queue_rejected_total",
+		Help: "Total number of requests rejected because an app's normal (non-long-running) queue was full.",
+	}, []string{"app"})
+
+	longRunningRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpxy_long_running_rejected_total",
+		Help: "Total number of requests rejected because an app's dedicated long-running pool (max_long_running) was full.",
+	}, []string{"app"})
+
+	upstreamLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpxy_upstream_latency_seconds",
+		Help:    "Latency of the round-trip to the backend, labeled by app, backend and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"app", "backend", "method"})
+
+	bytesInTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpxy_bytes_in_total",
+		Help: "Total request body bytes received from clients on the normal (non-long-running) path, labeled by app. Long-running request bodies are not counted.",
+	}, []string{"app"})
+
+	bytesOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpxy_bytes_out_total",
+		Help: "Total upstream response body bytes as declared by Content-Length, labeled by app. Responses without a Content-Length are not counted, and compression is not reflected.",
+	}, []string{"app"})
+
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpxy_backend_healthy",
+		Help: "1 if active health checks currently consider the backend healthy, 0 otherwise.",
+	}, []string{"app", "backend"})
+)
+
+// recordUpstreamMetrics records request/latency/byte metrics for a round trip
+// that reached the backend. app and resp.Request are the director-rewritten
+// outbound request, so resp.Request.URL.Host is the backend that served it.
+func recordUpstreamMetrics(app *App, resp *http.Response) {
+	method := resp.Request.Method
+	backend := resp.Request.URL.Host
+	status := strconv.Itoa(resp.StatusCode)
+
+	requestsTotal.WithLabelValues(app.ServerName, backend, method, status).Inc()
+	if resp.ContentLength > 0 {
+		bytesOutTotal.WithLabelValues(app.ServerName).Add(float64(resp.ContentLength))
+	}
+	if start, ok := resp.Request.Context().Value(startTimeKey).(time.Time); ok {
+		upstreamLatencySeconds.WithLabelValues(app.ServerName, backend, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordUpstreamError records a request/status metric for a round trip that
+// failed before a response was received (dial/timeout/etc).
+func recordUpstreamError(app *App, r *http.Request, status int) {
+	requestsTotal.WithLabelValues(app.ServerName, r.URL.Host, r.Method, strconv.Itoa(status)).Inc()
+}
+
+// startMetricsServer exposes /metrics in Prometheus text format. If
+// Global.MetricsPort is unset it is mounted on mux (typically the CDN
+// server's mux) instead of opening a dedicated listener.
+func startMetricsServer(global Global, mux *http.ServeMux) {
+	if global.MetricsPort == "" {
+		mux.Handle("/metrics", promhttp.Handler())
+		return
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Starting Metrics Server on %s", global.MetricsPort)
+		log.Fatal(http.ListenAndServe(global.MetricsPort, metricsMux))
+	}()
+}